@@ -0,0 +1,294 @@
+// Copyright 2018 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package driverloader prepares a node for QAT workloads before the
+// device plugin itself starts: it makes sure the QAT kernel modules and
+// firmware the plugin's other modes depend on are present, building and
+// installing them from a pinned out-of-tree source tarball when the
+// node's in-tree modules aren't enough. It is meant to be run as an init
+// container ("driver install") ahead of the main plugin process, and
+// torn down with "driver cleanup" if the node is decommissioned.
+package driverloader
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/intel/intel-device-plugins-for-kubernetes/pkg/debug"
+)
+
+const (
+	defaultHostRoot    = "/host"
+	defaultFirmwareDir = "/lib/firmware"
+	buildDir           = "/tmp/qat-driver-build"
+)
+
+// qatPerDeviceModules lists the in-tree per-device QAT kernel modules.
+// intel_qat alone only provides the shared core: a node isn't actually
+// provisioned until one of these, matching the QAT hardware present, is
+// loaded too.
+var qatPerDeviceModules = []string{
+	"qat_dh895xcc",
+	"qat_c62x",
+	"qat_c3xxx",
+	"qat_d15xx",
+	"qat_c4xxx",
+	"qat_200xx",
+	"qat_4xxx",
+}
+
+// Config controls where the driver and firmware come from and how they
+// get applied to the host.
+type Config struct {
+	// DriverURL is where the pinned out-of-tree driver tarball is
+	// downloaded from when the in-tree intel_qat module isn't enough.
+	DriverURL string
+	// HostRoot is the path the host's root filesystem is mounted at,
+	// e.g. "/host" when driverloader runs as an init container that
+	// bind-mounts the host's "/".
+	HostRoot string
+}
+
+// Loader installs or removes the QAT kernel module and firmware on a
+// node.
+type Loader struct {
+	cfg Config
+}
+
+// New creates a Loader configured by cfg. Zero-valued fields in cfg are
+// replaced with their defaults.
+func New(cfg Config) *Loader {
+	if cfg.HostRoot == "" {
+		cfg.HostRoot = defaultHostRoot
+	}
+	return &Loader{cfg: cfg}
+}
+
+// Install makes sure a working QAT driver is loaded on the host: it
+// first checks whether the in-tree modules are already loaded, and if
+// not, downloads, builds and insmods the pinned out-of-tree driver and
+// stages its firmware. Install is idempotent.
+func (l *Loader) Install() error {
+	loaded, err := l.modulesLoaded()
+	if err != nil {
+		return err
+	}
+	if loaded {
+		debug.Print("QAT kernel modules already loaded, nothing to do")
+		return nil
+	}
+
+	kernelVersion, err := l.kernelVersion()
+	if err != nil {
+		return err
+	}
+
+	archive, err := l.download()
+	if err != nil {
+		return err
+	}
+
+	srcDir := path.Join(buildDir, "src")
+	if err := l.extract(archive, srcDir); err != nil {
+		return err
+	}
+
+	if err := l.build(srcDir, kernelVersion); err != nil {
+		return err
+	}
+
+	if err := l.insmod(srcDir); err != nil {
+		return err
+	}
+
+	return l.stageFirmware(srcDir)
+}
+
+// Cleanup reverses Install: it removes the QAT kernel modules, the
+// firmware Install staged and the build artifacts left under buildDir.
+func (l *Loader) Cleanup() error {
+	if err := l.rmmod(); err != nil {
+		debug.Printf("rmmod failed (module may not be loaded): %+v", err)
+	}
+
+	firmwareGlob := path.Join(l.chroot(defaultFirmwareDir), "qat_*")
+	matches, _ := filepath.Glob(firmwareGlob)
+	for _, m := range matches {
+		if err := os.Remove(m); err != nil {
+			debug.Printf("failed to remove firmware %s: %+v", m, err)
+		}
+	}
+
+	return os.RemoveAll(buildDir)
+}
+
+// PrintEnv prints the resolved kernel version, driver source and
+// install destinations, for debugging a failed Install/Cleanup.
+func (l *Loader) PrintEnv() error {
+	kernelVersion, err := l.kernelVersion()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("kernel version:   %s\n", kernelVersion)
+	fmt.Printf("driver url:       %s\n", l.cfg.DriverURL)
+	fmt.Printf("host root:        %s\n", l.cfg.HostRoot)
+	fmt.Printf("build dir:        %s\n", buildDir)
+	fmt.Printf("firmware dest:    %s\n", l.chroot(defaultFirmwareDir))
+
+	return nil
+}
+
+func (l *Loader) chroot(p string) string {
+	return path.Join(l.cfg.HostRoot, p)
+}
+
+func (l *Loader) kernelVersion() (string, error) {
+	out, err := exec.Command("uname", "-r").Output()
+	if err != nil {
+		return "", errors.Wrap(err, "failed to determine kernel version")
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func (l *Loader) modulesLoaded() (bool, error) {
+	data, err := ioutil.ReadFile(l.chroot("/proc/modules"))
+	if err != nil {
+		return false, errors.Wrap(err, "failed to read /proc/modules")
+	}
+
+	if !strings.Contains(string(data), "intel_qat") {
+		return false, nil
+	}
+
+	for _, module := range qatPerDeviceModules {
+		if strings.Contains(string(data), module) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (l *Loader) download() (string, error) {
+	if l.cfg.DriverURL == "" {
+		return "", errors.New("no -driver-url configured and in-tree QAT modules aren't loaded")
+	}
+
+	if err := os.MkdirAll(buildDir, 0755); err != nil {
+		return "", errors.Wrap(err, "failed to create build dir")
+	}
+
+	archive := path.Join(buildDir, "qat-driver.tar.gz")
+	// #nosec G204 -- DriverURL is an administrator-supplied flag, not
+	// untrusted input.
+	cmd := exec.Command("curl", "-fsSL", "-o", archive, l.cfg.DriverURL)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return "", errors.Wrapf(err, "failed to download %s: %s", l.cfg.DriverURL, out)
+	}
+
+	return archive, nil
+}
+
+func (l *Loader) extract(archive, dest string) error {
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return errors.Wrap(err, "failed to create extraction dir")
+	}
+
+	cmd := exec.Command("tar", "-xzf", archive, "-C", dest, "--strip-components=1")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "failed to extract %s: %s", archive, out)
+	}
+
+	return nil
+}
+
+func (l *Loader) build(srcDir, kernelVersion string) error {
+	headers := l.chroot(path.Join("/usr/src", "kernels", kernelVersion))
+
+	cmd := exec.Command("make", "-C", srcDir, "KERNEL_SOURCE_ROOT="+headers)
+	cmd.Dir = srcDir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "failed to build driver: %s", out)
+	}
+
+	return nil
+}
+
+func (l *Loader) insmod(srcDir string) error {
+	cmd := exec.Command("insmod", path.Join(srcDir, "intel_qat.ko"))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "insmod failed: %s", out)
+	}
+
+	// intel_qat is only the shared core: also load the per-device
+	// modules built alongside it, which modulesLoaded looks for.
+	for _, module := range qatPerDeviceModules {
+		ko := path.Join(srcDir, module+".ko")
+		if _, err := os.Stat(ko); err != nil {
+			continue
+		}
+		if out, err := exec.Command("insmod", ko).CombinedOutput(); err != nil {
+			return errors.Wrapf(err, "insmod %s failed: %s", module, out)
+		}
+	}
+	return nil
+}
+
+func (l *Loader) rmmod() error {
+	// The per-device modules depend on intel_qat and must go first. Most
+	// of them aren't loaded on any given node, so their errors are
+	// ignored.
+	for _, module := range qatPerDeviceModules {
+		_ = exec.Command("rmmod", module).Run()
+	}
+
+	cmd := exec.Command("rmmod", "intel_qat")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "rmmod failed: %s", out)
+	}
+	return nil
+}
+
+func (l *Loader) stageFirmware(srcDir string) error {
+	matches, err := filepath.Glob(path.Join(srcDir, "firmware", "qat_*"))
+	if err != nil {
+		return err
+	}
+
+	destDir := l.chroot(defaultFirmwareDir)
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return errors.Wrap(err, "failed to create firmware dest dir")
+	}
+
+	for _, src := range matches {
+		dest := path.Join(destDir, path.Base(src))
+		data, err := ioutil.ReadFile(src)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read firmware %s", src)
+		}
+		if err := ioutil.WriteFile(dest, data, 0644); err != nil {
+			return errors.Wrapf(err, "failed to stage firmware to %s", dest)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2018 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driverloader
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newLoaderWithProcModules returns a Loader whose HostRoot is a fresh
+// temp dir containing a synthetic /proc/modules with the given content.
+func newLoaderWithProcModules(t *testing.T, content string) *Loader {
+	t.Helper()
+
+	root, err := ioutil.TempDir("", "driverloader-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(root) })
+
+	procDir := filepath.Join(root, "proc")
+	if err := os.MkdirAll(procDir, 0755); err != nil {
+		t.Fatalf("failed to create %s: %v", procDir, err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(procDir, "modules"), []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write /proc/modules: %v", err)
+	}
+
+	return New(Config{HostRoot: root})
+}
+
+func TestModulesLoadedRequiresCoreAndPerDeviceModule(t *testing.T) {
+	l := newLoaderWithProcModules(t, "intel_qat 131072 1 - Live 0x0000000000000000\nqat_c62x 16384 0 - Live 0x0000000000000000\n")
+
+	loaded, err := l.modulesLoaded()
+	if err != nil {
+		t.Fatalf("modulesLoaded failed: %v", err)
+	}
+	if !loaded {
+		t.Error("expected modulesLoaded to report true with both intel_qat and a per-device module loaded")
+	}
+}
+
+func TestModulesLoadedFalseWithoutPerDeviceModule(t *testing.T) {
+	l := newLoaderWithProcModules(t, "intel_qat 131072 1 - Live 0x0000000000000000\n")
+
+	loaded, err := l.modulesLoaded()
+	if err != nil {
+		t.Fatalf("modulesLoaded failed: %v", err)
+	}
+	if loaded {
+		t.Error("expected modulesLoaded to report false with intel_qat loaded but no per-device kmod")
+	}
+}
+
+func TestModulesLoadedFalseWithNeitherModule(t *testing.T) {
+	l := newLoaderWithProcModules(t, "ext4 135168 1 - Live 0x0000000000000000\n")
+
+	loaded, err := l.modulesLoaded()
+	if err != nil {
+		t.Fatalf("modulesLoaded failed: %v", err)
+	}
+	if loaded {
+		t.Error("expected modulesLoaded to report false with no QAT modules loaded")
+	}
+}
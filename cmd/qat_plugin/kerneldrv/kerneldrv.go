@@ -0,0 +1,131 @@
+// Copyright 2017 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package kerneldrv implements the QAT device plugin for nodes where QAT
+// acceleration is exposed through the in-kernel crypto API rather than
+// through VFIO-bound VFs.
+package kerneldrv
+
+import (
+	"io/ioutil"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/intel/intel-device-plugins-for-kubernetes/cmd/qat_plugin/qatservices"
+	"github.com/intel/intel-device-plugins-for-kubernetes/pkg/deviceplugin"
+)
+
+// pciDriversPath and qatConfDir are vars rather than consts so tests can
+// point them at a synthetic sysfs/config tree.
+var (
+	pciDriversPath = "/sys/bus/pci/drivers"
+	qatConfDir     = "/etc"
+)
+
+const scanPeriod = 5 * time.Second
+
+// pfDrivers lists the in-kernel QAT PF driver names this plugin looks
+// for bound PCI devices under. Each name also doubles as the prefix of
+// that family's QAT config file, e.g. bound devices under
+// /sys/bus/pci/drivers/c6xx/ read their services from
+// /etc/c6xx_dev<N>.conf.
+var pfDrivers = []string{"dh895xcc", "c6xx", "c3xxx", "d15xx", "c4xxx", "200xx", "qat"}
+
+type devicePlugin struct {
+	servicesOverride []string
+}
+
+// NewDevicePlugin returns a deviceplugin.Scanner for QAT devices that are
+// bound to the host's in-kernel QAT driver.
+//
+// Each PF bound to one of pfDrivers is advertised as a device under the
+// resource name(s) its QAT config file's ServicesEnabled setting maps
+// to (e.g. "cy", "dc"), resolved through the same qatservices alias map
+// vfiodrv uses. If services is non-empty it overrides that discovery
+// and every PF found is advertised under exactly the resources listed
+// there instead. A node with no bound in-kernel QAT PF advertises
+// nothing, rather than a schedulable resource nothing backs.
+func NewDevicePlugin(services string) (deviceplugin.Scanner, error) {
+	servicesOverride, err := qatservices.ResolveList(services)
+	if err != nil {
+		return nil, err
+	}
+
+	return &devicePlugin{servicesOverride: servicesOverride}, nil
+}
+
+func (dp *devicePlugin) Scan(notifier deviceplugin.Notifier) error {
+	for {
+		notifier.Notify(dp.scan())
+		time.Sleep(scanPeriod)
+	}
+}
+
+func (dp *devicePlugin) scan() deviceplugin.DeviceTree {
+	tree := deviceplugin.NewDeviceTree()
+
+	for _, driver := range pfDrivers {
+		entries, err := ioutil.ReadDir(path.Join(pciDriversPath, driver))
+		if err != nil {
+			// The driver may simply not be loaded on this node: that's
+			// not fatal, just means this family has no PFs here.
+			continue
+		}
+
+		var pfs []string
+		for _, entry := range entries {
+			if isPCIAddress(entry.Name()) {
+				pfs = append(pfs, entry.Name())
+			}
+		}
+		sort.Strings(pfs)
+
+		for index, pf := range pfs {
+			services, err := dp.servicesForPF(driver, index)
+			if err != nil {
+				// Leave the PF unadvertised rather than failing the
+				// whole scan: a misconfigured or not-yet-written PF
+				// config file shouldn't take every other device down.
+				continue
+			}
+
+			for _, service := range services {
+				tree.AddDevice(service, pf, deviceplugin.DeviceInfo{State: "Healthy"})
+			}
+		}
+	}
+
+	return tree
+}
+
+// servicesForPF returns the resource names the PF at the given position
+// among same-driver PFs should be advertised under.
+func (dp *devicePlugin) servicesForPF(driver string, index int) ([]string, error) {
+	if dp.servicesOverride != nil {
+		return dp.servicesOverride, nil
+	}
+
+	confPath := path.Join(qatConfDir, driver+"_dev"+strconv.Itoa(index)+".conf")
+	return qatservices.ParseConfigFile(confPath)
+}
+
+// isPCIAddress reports whether name looks like a PCI BDF address
+// (DDDD:BB:DD.F), which is how bound devices show up as symlinks under
+// /sys/bus/pci/drivers/<driver>/.
+func isPCIAddress(name string) bool {
+	return strings.Count(name, ":") == 2 && strings.Contains(name, ".")
+}
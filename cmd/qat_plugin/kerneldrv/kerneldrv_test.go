@@ -0,0 +1,136 @@
+// Copyright 2018 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kerneldrv
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// withSyntheticSysfs points pciDriversPath and qatConfDir at fresh temp
+// directories for the duration of the test.
+func withSyntheticSysfs(t *testing.T) (driversDir, confDir string) {
+	t.Helper()
+
+	root, err := ioutil.TempDir("", "kerneldrv-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(root) })
+
+	driversDir = filepath.Join(root, "drivers")
+	confDir = filepath.Join(root, "etc")
+	for _, d := range []string{driversDir, confDir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatalf("failed to create %s: %v", d, err)
+		}
+	}
+
+	origDrivers, origConf := pciDriversPath, qatConfDir
+	pciDriversPath, qatConfDir = driversDir, confDir
+	t.Cleanup(func() {
+		pciDriversPath, qatConfDir = origDrivers, origConf
+	})
+
+	return driversDir, confDir
+}
+
+// addPF wires up a synthetic PF at bdf bound to driver.
+func addPF(t *testing.T, driversDir, driver, bdf string) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Join(driversDir, driver, bdf), 0755); err != nil {
+		t.Fatalf("failed to bind PF %s to %s: %v", bdf, driver, err)
+	}
+}
+
+func writeConf(t *testing.T, confDir, driver string, index int, servicesEnabled string) {
+	t.Helper()
+
+	name := driver + "_dev" + strconv.Itoa(index) + ".conf"
+	content := "ServicesEnabled = " + servicesEnabled + "\n"
+	if err := ioutil.WriteFile(filepath.Join(confDir, name), []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write %s: %v", name, err)
+	}
+}
+
+func TestScanAdvertisesNothingWithNoHardware(t *testing.T) {
+	withSyntheticSysfs(t)
+
+	dp, err := NewDevicePlugin("")
+	if err != nil {
+		t.Fatalf("NewDevicePlugin failed: %v", err)
+	}
+
+	tree := dp.(*devicePlugin).scan()
+	if len(tree) != 0 {
+		t.Errorf("expected no resources advertised with no bound QAT PF, got %+v", tree)
+	}
+}
+
+func TestScanDerivesServicesFromConfig(t *testing.T) {
+	driversDir, confDir := withSyntheticSysfs(t)
+
+	addPF(t, driversDir, "c6xx", "0000:1a:00.0")
+	writeConf(t, confDir, "c6xx", 0, "cy;dc")
+
+	dp, err := NewDevicePlugin("")
+	if err != nil {
+		t.Fatalf("NewDevicePlugin failed: %v", err)
+	}
+
+	tree := dp.(*devicePlugin).scan()
+	if _, ok := tree["cy"]["0000:1a:00.0"]; !ok {
+		t.Errorf("expected PF 0000:1a:00.0 advertised under \"cy\", tree: %+v", tree)
+	}
+	if _, ok := tree["dc"]["0000:1a:00.0"]; !ok {
+		t.Errorf("expected PF 0000:1a:00.0 advertised under \"dc\", tree: %+v", tree)
+	}
+}
+
+func TestScanIgnoresPFWithoutConfig(t *testing.T) {
+	driversDir, _ := withSyntheticSysfs(t)
+
+	addPF(t, driversDir, "c6xx", "0000:1a:00.0")
+
+	dp, err := NewDevicePlugin("")
+	if err != nil {
+		t.Fatalf("NewDevicePlugin failed: %v", err)
+	}
+
+	tree := dp.(*devicePlugin).scan()
+	if len(tree) != 0 {
+		t.Errorf("expected no resources advertised for a PF with no config file, got %+v", tree)
+	}
+}
+
+func TestServicesOverrideAppliesToEveryPF(t *testing.T) {
+	driversDir, _ := withSyntheticSysfs(t)
+
+	addPF(t, driversDir, "c6xx", "0000:1a:00.0")
+
+	dp, err := NewDevicePlugin("asym")
+	if err != nil {
+		t.Fatalf("NewDevicePlugin failed: %v", err)
+	}
+
+	tree := dp.(*devicePlugin).scan()
+	if _, ok := tree["asym"]["0000:1a:00.0"]; !ok {
+		t.Errorf("expected -services override to advertise 0000:1a:00.0 under \"asym\", tree: %+v", tree)
+	}
+}
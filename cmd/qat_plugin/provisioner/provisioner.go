@@ -0,0 +1,272 @@
+// Copyright 2018 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package provisioner optionally prepares QAT hardware for the device
+// plugin by creating SR-IOV VFs on QAT PFs and binding them to
+// vfio-pci, so that users don't have to do so by hand before the
+// plugin can see any devices.
+package provisioner
+
+import (
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/intel/intel-device-plugins-for-kubernetes/pkg/debug"
+)
+
+const (
+	pciDevicesPath = "/sys/bus/pci/devices"
+	vfioNewIDPath  = "/sys/bus/pci/drivers/vfio-pci/new_id"
+	vfioBindPath   = "/sys/bus/pci/drivers/vfio-pci/bind"
+	vendorIntel    = "0x8086"
+)
+
+// qatPFDeviceIDs lists the PCI device IDs of known QAT physical
+// functions, all under vendorIntel. A PF matching one of these is a
+// provisioning candidate regardless of which VF driver it will end up
+// binding its VFs to.
+var qatPFDeviceIDs = []string{
+	"0x0435", // DH895xCC
+	"0x37c8", // C62x
+	"0x19e2", // C3xxx
+	"0x6f54", // D15xx
+	"0x18a0", // C4xxx
+	"0x18ee", // 200xx
+}
+
+// Config controls how Provisioner sets up VFs.
+type Config struct {
+	// VFsPerPF is the number of VFs to create on each PF that currently
+	// has none.
+	VFsPerPF int
+	// Cleanup, if true, makes Close() undo everything Provision() did:
+	// unbind the VFs from vfio-pci and set sriov_numvfs back to 0.
+	Cleanup bool
+}
+
+// Provisioner creates SR-IOV VFs on QAT PFs and binds them to vfio-pci.
+type Provisioner struct {
+	cfg Config
+	// provisionedVFs maps a PF's BDF to the VFs this Provisioner created
+	// and bound, so Close() can roll them back.
+	provisionedVFs map[string][]string
+}
+
+// New creates a Provisioner configured by cfg.
+func New(cfg Config) *Provisioner {
+	return &Provisioner{
+		cfg:            cfg,
+		provisionedVFs: make(map[string][]string),
+	}
+}
+
+// Provision enumerates QAT PFs, creates VFsPerPF VFs on every PF that
+// doesn't already have VFs, and binds each new VF to vfio-pci.
+//
+// A single PF that fails to provision (e.g. one that doesn't support
+// SR-IOV despite matching a known QAT device ID) is logged and skipped
+// rather than aborting startup: the plugin should still come up and
+// serve the PFs that did provision successfully.
+func (p *Provisioner) Provision() error {
+	pfs, err := findQATPFs()
+	if err != nil {
+		return err
+	}
+
+	for _, pf := range pfs {
+		if err := p.provisionPF(pf); err != nil {
+			debug.Printf("failed to provision PF %s: %+v", pf, err)
+		}
+	}
+
+	return nil
+}
+
+// Close reverses Provision if Cleanup was requested in the Config.
+func (p *Provisioner) Close() error {
+	if !p.cfg.Cleanup {
+		return nil
+	}
+
+	for pf, vfs := range p.provisionedVFs {
+		for _, vf := range vfs {
+			if err := unbindFromVfio(vf); err != nil {
+				debug.Printf("failed to unbind %s from vfio-pci: %+v", vf, err)
+			}
+		}
+		if err := writeSysfs(path.Join(pciDevicesPath, pf, "sriov_numvfs"), "0"); err != nil {
+			debug.Printf("failed to reset sriov_numvfs on %s: %+v", pf, err)
+		}
+	}
+
+	return nil
+}
+
+func (p *Provisioner) provisionPF(pf string) error {
+	numVFs, err := readSysfsInt(path.Join(pciDevicesPath, pf, "sriov_numvfs"))
+	if err != nil {
+		return err
+	}
+
+	if numVFs != 0 {
+		// The PF already has VFs the user (or a previous run without
+		// -provision-cleanup) set up: leave them and their driver
+		// binding alone rather than rebinding, and possibly later
+		// tearing down, config this Provisioner never created.
+		return nil
+	}
+
+	totalVFs, err := readSysfsInt(path.Join(pciDevicesPath, pf, "sriov_totalvfs"))
+	if err != nil {
+		return err
+	}
+
+	requested := p.cfg.VFsPerPF
+	if requested > totalVFs {
+		requested = totalVFs
+	}
+
+	if err := writeSysfs(path.Join(pciDevicesPath, pf, "sriov_numvfs"), strconv.Itoa(requested)); err != nil {
+		return err
+	}
+	// Record the PF as soon as its VFs exist, so Close() resets
+	// sriov_numvfs even if binding one of them below fails.
+	p.provisionedVFs[pf] = nil
+
+	vfs, err := findVFs(pf)
+	if err != nil {
+		return err
+	}
+
+	for _, vf := range vfs {
+		if err := bindToVfio(vf); err != nil {
+			return errors.Wrapf(err, "failed to bind VF %s to vfio-pci", vf)
+		}
+		p.provisionedVFs[pf] = append(p.provisionedVFs[pf], vf)
+	}
+
+	return nil
+}
+
+func findQATPFs() ([]string, error) {
+	entries, err := ioutil.ReadDir(pciDevicesPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list PCI devices")
+	}
+
+	var pfs []string
+	for _, entry := range entries {
+		bdf := entry.Name()
+
+		vendor, err := readSysfs(path.Join(pciDevicesPath, bdf, "vendor"))
+		if err != nil || vendor != vendorIntel {
+			continue
+		}
+
+		device, err := readSysfs(path.Join(pciDevicesPath, bdf, "device"))
+		if err != nil || !isQATPFDevice(device) {
+			continue
+		}
+
+		pfs = append(pfs, bdf)
+	}
+
+	return pfs, nil
+}
+
+func isQATPFDevice(deviceID string) bool {
+	for _, id := range qatPFDeviceIDs {
+		if id == deviceID {
+			return true
+		}
+	}
+	return false
+}
+
+func findVFs(pf string) ([]string, error) {
+	matches, err := filepath.Glob(path.Join(pciDevicesPath, pf, "virtfn*"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to enumerate VFs of %s", pf)
+	}
+
+	var vfs []string
+	for _, m := range matches {
+		target, err := filepath.EvalSymlinks(m)
+		if err != nil {
+			continue
+		}
+		vfs = append(vfs, filepath.Base(target))
+	}
+
+	return vfs, nil
+}
+
+func bindToVfio(vf string) error {
+	vendor, err := readSysfs(path.Join(pciDevicesPath, vf, "vendor"))
+	if err != nil {
+		return err
+	}
+	device, err := readSysfs(path.Join(pciDevicesPath, vf, "device"))
+	if err != nil {
+		return err
+	}
+
+	driverLink := path.Join(pciDevicesPath, vf, "driver")
+	if _, err := filepath.EvalSymlinks(driverLink); err == nil {
+		if err := writeSysfs(path.Join(driverLink, "unbind"), vf); err != nil {
+			return err
+		}
+	}
+
+	id := strings.TrimPrefix(vendor, "0x") + " " + strings.TrimPrefix(device, "0x")
+	if err := writeSysfs(vfioNewIDPath, id); err != nil {
+		// new_id returns an error if the ID is already registered,
+		// which is harmless: fall through to the explicit bind.
+		debug.Printf("new_id for %s: %+v", vf, err)
+	}
+
+	return writeSysfs(vfioBindPath, vf)
+}
+
+func unbindFromVfio(vf string) error {
+	return writeSysfs(path.Join(pciDevicesPath, vf, "driver", "unbind"), vf)
+}
+
+func readSysfs(p string) (string, error) {
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read %s", p)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func readSysfsInt(p string) (int, error) {
+	s, err := readSysfs(p)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(s)
+}
+
+func writeSysfs(p, value string) error {
+	if err := ioutil.WriteFile(p, []byte(value), 0200); err != nil {
+		return errors.Wrapf(err, "failed to write %q to %s", value, p)
+	}
+	return nil
+}
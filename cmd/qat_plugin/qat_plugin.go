@@ -18,10 +18,14 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/pkg/errors"
 
+	"github.com/intel/intel-device-plugins-for-kubernetes/cmd/qat_plugin/driverloader"
 	"github.com/intel/intel-device-plugins-for-kubernetes/cmd/qat_plugin/kerneldrv"
+	"github.com/intel/intel-device-plugins-for-kubernetes/cmd/qat_plugin/provisioner"
 	"github.com/intel/intel-device-plugins-for-kubernetes/cmd/qat_plugin/vfiodrv"
 	"github.com/intel/intel-device-plugins-for-kubernetes/pkg/debug"
 	"github.com/intel/intel-device-plugins-for-kubernetes/pkg/deviceplugin"
@@ -36,22 +40,60 @@ func main() {
 	var err error
 
 	debugEnabled := flag.Bool("debug", false, "enable debug output")
-	mode := flag.String("mode", "vfio", "plugin mode which can be either vfio (default) or kernel")
+	mode := flag.String("mode", "vfio", "plugin mode which can be vfio (default), kernel or driver")
+
+	driverURL := flag.String("driver-url", "", "URL of the pinned QAT out-of-tree driver tarball, used by '-mode=driver install'")
+	hostRoot := flag.String("host-root", "", "path the host root filesystem is mounted at, used by '-mode=driver'")
 
 	dpdkDriver := flag.String("dpdk-driver", "vfio-pci", "DPDK Device driver for configuring the QAT device")
-	kernelVfDrivers := flag.String("kernel-vf-drivers", "dh895xccvf,c6xxvf,c3xxxvf,d15xxvf", "Comma separated VF Device Driver of the QuickAssist Devices in the system. Devices supported: DH895xCC,C62x,C3xxx and D15xx")
+	kernelVfDrivers := flag.String("kernel-vf-drivers", vfiodrv.DefaultKernelVfDrivers(), "Comma separated VF Device Driver of the QuickAssist Devices in the system. Devices supported: DH895xCC,C62x,C3xxx,D15xx,C4xxx and 200xx")
 	maxNumDevices := flag.Int("max-num-devices", 32, "maximum number of QAT devices to be provided to the QuickAssist device plugin")
+	services := flag.String("services", "", "Comma separated list of services (cy, dc, asym) to advertise devices under, overriding discovery from the QAT config files")
+	qatGen := flag.String("qat-gen", "", "QAT generation hint (2, 3 or 4) used to select the unified gen4 'qat' VF driver; left empty, gen4 hardware is auto-detected by PCI ID")
+	provisionVfs := flag.String("provision-vfs", "", "set to 'auto' to create SR-IOV VFs on QAT PFs and bind them to vfio-pci at startup")
+	vfsPerPF := flag.Int("vfs-per-pf", 16, "number of VFs to create per PF when -provision-vfs=auto")
+	provisionCleanup := flag.Bool("provision-cleanup", false, "when set, undo -provision-vfs=auto's VF creation and vfio-pci binding on shutdown")
 	flag.Parse()
 
 	if *debugEnabled {
 		debug.Activate()
 	}
 
+	if *provisionVfs == "auto" {
+		if *mode != "vfio" {
+			// Provisioning binds VFs to vfio-pci, which would steal
+			// them away from the in-kernel QAT driver -mode=kernel
+			// depends on.
+			fmt.Printf("-provision-vfs=auto is only supported with -mode=vfio, ignoring it for -mode=%s\n", *mode)
+		} else {
+			prov := provisioner.New(provisioner.Config{
+				VFsPerPF: *vfsPerPF,
+				Cleanup:  *provisionCleanup,
+			})
+			if err := prov.Provision(); err != nil {
+				fmt.Println(err.Error())
+				os.Exit(1)
+			}
+			// The manager below never returns, so roll back on the
+			// signal that stops the plugin instead of in a defer.
+			sigs := make(chan os.Signal, 1)
+			signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+			go func() {
+				<-sigs
+				prov.Close()
+				os.Exit(0)
+			}()
+		}
+	}
+
 	switch *mode {
 	case "vfio":
-		plugin, err = vfiodrv.NewDevicePlugin(*maxNumDevices, *kernelVfDrivers, *dpdkDriver)
+		plugin, err = vfiodrv.NewDevicePlugin(*maxNumDevices, *kernelVfDrivers, *dpdkDriver, *services, *qatGen)
 	case "kernel":
-		plugin = kerneldrv.NewDevicePlugin()
+		plugin, err = kerneldrv.NewDevicePlugin(*services)
+	case "driver":
+		runDriverLoader(*driverURL, *hostRoot, flag.Arg(0))
+		return
 	default:
 		err = errors.Errorf("Uknown mode: %s", *mode)
 	}
@@ -64,3 +106,30 @@ func main() {
 	manager := deviceplugin.NewManager(namespace, plugin)
 	manager.Run()
 }
+
+// runDriverLoader handles "-mode=driver <action>", where action is one
+// of "install", "cleanup" or "printenv". It never returns: it exits the
+// process with a status reflecting whether the action succeeded.
+func runDriverLoader(driverURL, hostRoot, action string) {
+	loader := driverloader.New(driverloader.Config{
+		DriverURL: driverURL,
+		HostRoot:  hostRoot,
+	})
+
+	var err error
+	switch action {
+	case "install":
+		err = loader.Install()
+	case "cleanup":
+		err = loader.Cleanup()
+	case "printenv":
+		err = loader.PrintEnv()
+	default:
+		err = errors.Errorf("Uknown driver action: %q, expected install, cleanup or printenv", action)
+	}
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,120 @@
+// Copyright 2018 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package qatservices maps the values QAT surfaces a device's enabled
+// services under (PF config file ServicesEnabled settings, the sysfs
+// cfg_services attribute, and the -services override flag) to the
+// resource names the QAT device plugins advertise devices under. All
+// QAT plugin modes resolve services through this package so that the
+// same flag value means the same thing regardless of mode.
+package qatservices
+
+import (
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// tokenAliases maps a single QAT service token to the resource name it
+// is advertised under. A full ServicesEnabled/cfg_services value
+// combines tokens with ";" (e.g. "sym;asym;dc"): Resolve splits on that
+// separator and maps each token through this table rather than matching
+// the whole value against a fixed set of combinations, so any
+// combination of known tokens is recognized.
+var tokenAliases = map[string]string{
+	"cy":      "cy",
+	"sym":     "cy",
+	"cy_only": "cy",
+	"dc":      "dc",
+	"dc_only": "dc",
+	"asym":    "asym",
+}
+
+// Resolve returns the resource name(s) that a single QAT service value
+// maps to.
+func Resolve(value string) ([]string, error) {
+	var resourceNames []string
+	seen := make(map[string]bool)
+
+	for _, token := range strings.Split(value, ";") {
+		resourceName, ok := tokenAliases[strings.TrimSpace(token)]
+		if !ok {
+			return nil, errors.Errorf("unrecognized QAT service value %q", value)
+		}
+		if seen[resourceName] {
+			continue
+		}
+		seen[resourceName] = true
+		resourceNames = append(resourceNames, resourceName)
+	}
+
+	return resourceNames, nil
+}
+
+// ResolveList resolves a comma separated list of QAT service values
+// (e.g. the -services flag) to the deduplicated resource names they map
+// to, preserving the order in which each resource name first appears.
+func ResolveList(csv string) ([]string, error) {
+	if csv == "" {
+		return nil, nil
+	}
+
+	var resourceNames []string
+	seen := make(map[string]bool)
+
+	for _, value := range strings.Split(csv, ",") {
+		services, err := Resolve(value)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, resourceName := range services {
+			if seen[resourceName] {
+				continue
+			}
+			seen[resourceName] = true
+			resourceNames = append(resourceNames, resourceName)
+		}
+	}
+
+	return resourceNames, nil
+}
+
+// ParseConfigFile reads a QAT PF config file (e.g. /etc/c6xx_dev0.conf)
+// and returns the resource name(s) its ServicesEnabled setting maps to.
+// Both vfiodrv and kerneldrv derive a PF's advertised resources from
+// this same file format.
+func ParseConfigFile(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", path)
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "ServicesEnabled") {
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		return Resolve(strings.TrimSpace(parts[1]))
+	}
+
+	return nil, errors.Errorf("no ServicesEnabled setting found in %s", path)
+}
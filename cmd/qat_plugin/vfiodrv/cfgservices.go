@@ -0,0 +1,122 @@
+// Copyright 2018 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfiodrv
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/intel/intel-device-plugins-for-kubernetes/cmd/qat_plugin/qatservices"
+)
+
+// qatConfDir and pciBusPath are vars rather than consts so tests can
+// point them at a synthetic sysfs/config tree.
+var (
+	qatConfDir = "/etc"
+	pciBusPath = "/sys/bus/pci/devices"
+)
+
+// pfConfPath returns the path of the QAT config file of the PF that the
+// VF at bdf belongs to, e.g. /etc/c6xx_dev0.conf.
+func pfConfPath(bdf string, family qatFamily) (string, error) {
+	pfBDF, err := physfn(bdf)
+	if err != nil {
+		return "", err
+	}
+
+	index, err := pfIndex(pfBDF, family)
+	if err != nil {
+		return "", err
+	}
+
+	return path.Join(qatConfDir, family.confPrefix+"_dev"+strconv.Itoa(index)+".conf"), nil
+}
+
+// physfn resolves the PCI address of the physical function backing the
+// VF at bdf by following /sys/bus/pci/devices/<bdf>/physfn.
+func physfn(bdf string) (string, error) {
+	link := path.Join(pciBusPath, bdf, "physfn")
+
+	target, err := os.Readlink(link)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to resolve physfn of %s", bdf)
+	}
+
+	return filepath.Base(target), nil
+}
+
+// pfIndex returns the position of pfBDF among all PFs of the same
+// family on the system, sorted by PCI address. QAT numbers its config
+// files (dev0, dev1, ...) in that same order.
+func pfIndex(pfBDF string, family qatFamily) (int, error) {
+	pattern := path.Join(pciBusPath, "*")
+
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to enumerate PCI devices")
+	}
+
+	var pfs []string
+	for _, m := range matches {
+		driverLink := path.Join(m, "driver")
+		target, err := os.Readlink(driverLink)
+		if err != nil {
+			continue
+		}
+		if filepath.Base(target) == strings.TrimSuffix(family.vfDriver, "vf") {
+			pfs = append(pfs, filepath.Base(m))
+		}
+	}
+	sort.Strings(pfs)
+
+	for i, bdf := range pfs {
+		if bdf == pfBDF {
+			return i, nil
+		}
+	}
+
+	return 0, errors.Errorf("PF %s not found among %s devices", pfBDF, family.vfDriver)
+}
+
+// cfgServicesPath returns the path of the sysfs attribute gen4's unified
+// "qat" driver exposes on a VF to report its configured service split,
+// e.g. /sys/bus/pci/devices/0000:3d:00.1/qat/cfg_services.
+func cfgServicesPath(bdf string) string {
+	return path.Join(pciBusPath, bdf, "qat", "cfg_services")
+}
+
+// servicesFromCfgServices reads the cfg_services sysfs attribute of a
+// unified-driver VF and returns the resource names it maps to.
+func servicesFromCfgServices(bdf string) ([]string, error) {
+	data, err := ioutil.ReadFile(cfgServicesPath(bdf))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read cfg_services of %s", bdf)
+	}
+
+	return qatservices.Resolve(strings.TrimSpace(string(data)))
+}
+
+// servicesFromConfig reads a QAT config file and returns the resource
+// names its ServicesEnabled setting maps to.
+func servicesFromConfig(confPath string) ([]string, error) {
+	return qatservices.ParseConfigFile(confPath)
+}
@@ -0,0 +1,57 @@
+// Copyright 2018 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfiodrv
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// nodesForVF returns the device nodes a container must be given to
+// actually use the VF at bdf through vfio-pci: the VF's own IOMMU group
+// node under /dev/vfio, plus the shared /dev/vfio/vfio control node that
+// every mediated-device open (including gen4's) goes through.
+func nodesForVF(bdf string) ([]pluginapi.DeviceSpec, error) {
+	group, err := iommuGroup(bdf)
+	if err != nil {
+		return nil, err
+	}
+
+	groupNode := path.Join(vfioDevicePath, group)
+	controlNode := path.Join(vfioDevicePath, "vfio")
+
+	return []pluginapi.DeviceSpec{
+		{HostPath: groupNode, ContainerPath: groupNode, Permissions: "mrw"},
+		{HostPath: controlNode, ContainerPath: controlNode, Permissions: "mrw"},
+	}, nil
+}
+
+// iommuGroup resolves the IOMMU group number of the device at bdf via
+// /sys/bus/pci/devices/<bdf>/iommu_group, which is how its /dev/vfio/N
+// node is named.
+func iommuGroup(bdf string) (string, error) {
+	link := path.Join(pciBusPath, bdf, "iommu_group")
+
+	target, err := os.Readlink(link)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to resolve iommu_group of %s", bdf)
+	}
+
+	return filepath.Base(target), nil
+}
@@ -0,0 +1,346 @@
+// Copyright 2017 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package vfiodrv implements the QAT device plugin for nodes where QAT
+// VFs are bound to vfio-pci and handed to DPDK-based workloads. This
+// includes gen4 hardware bound to the unified "qat" VF driver, whose
+// per-VF service configuration is read from sysfs rather than a PF
+// config file.
+package vfiodrv
+
+import (
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/intel/intel-device-plugins-for-kubernetes/cmd/qat_plugin/qatservices"
+	"github.com/intel/intel-device-plugins-for-kubernetes/pkg/deviceplugin"
+)
+
+// pciDriversPath is a var rather than a const so tests can point it at a
+// synthetic sysfs tree.
+var pciDriversPath = "/sys/bus/pci/drivers"
+
+const (
+	vfioDevicePath = "/dev/vfio"
+	scanPeriod     = 5 * time.Second
+)
+
+// qatFamily describes the static, per-generation properties of a QAT VF
+// driver that the plugin needs in order to advertise its VFs correctly.
+// Keeping this data declarative means a new generation can be supported
+// by adding a table entry instead of teaching the scanner new string
+// matching.
+type qatFamily struct {
+	// vfDriver is the kernel VF driver name bound to devices of this
+	// family, e.g. "c6xxvf".
+	vfDriver string
+	// confPrefix is the prefix of the QAT config file for a PF of this
+	// family, e.g. "c6xx" for /etc/c6xx_dev0.conf.
+	confPrefix string
+	// maxVFsPerPF is the number of VFs a single PF of this family can
+	// expose.
+	maxVFsPerPF int
+	// services lists the acceleration services this family's VFs can be
+	// configured to provide.
+	services []string
+	// unified marks QAT gen4+ families that bind VFs directly to a
+	// single "qat" driver and report their configured service split
+	// per-VF via the sysfs cfg_services attribute, instead of per-PF
+	// config files under /etc. Such families are excluded from the
+	// default -kernel-vf-drivers list and are enabled via -qat-gen
+	// instead (or auto-detected by PCI ID).
+	unified bool
+	// vfPCIIDs lists the PCI device IDs (as read from
+	// /sys/bus/pci/devices/<bdf>/device, without the "0x" prefix) known
+	// to belong to this family's VFs. It is only set for unified
+	// families and backs -qat-gen's auto-detection.
+	vfPCIIDs []string
+}
+
+// qatFamilies is the default table of known QAT VF drivers. It is used
+// both to build the default -kernel-vf-drivers flag value and to look up
+// per-family metadata during device discovery.
+var qatFamilies = []qatFamily{
+	{vfDriver: "dh895xccvf", confPrefix: "dh895xcc", maxVFsPerPF: 32, services: []string{"cy"}},
+	{vfDriver: "c6xxvf", confPrefix: "c6xx", maxVFsPerPF: 16, services: []string{"cy", "dc"}},
+	{vfDriver: "c3xxxvf", confPrefix: "c3xxx", maxVFsPerPF: 16, services: []string{"cy", "dc"}},
+	{vfDriver: "d15xxvf", confPrefix: "d15xx", maxVFsPerPF: 16, services: []string{"cy", "dc"}},
+	{vfDriver: "c4xxxvf", confPrefix: "c4xxx", maxVFsPerPF: 16, services: []string{"cy", "dc", "asym"}},
+	{vfDriver: "200xxvf", confPrefix: "200xx", maxVFsPerPF: 16, services: []string{"cy", "dc", "asym"}},
+	{vfDriver: "qat", maxVFsPerPF: 16, services: []string{"cy", "dc", "asym"}, unified: true, vfPCIIDs: []string{"4941", "4942"}},
+}
+
+// DefaultKernelVfDrivers is the comma separated list of VF driver names
+// the plugin recognizes out of the box, in the order listed in
+// qatFamilies. Unified-driver families such as gen4's "qat" are opt-in
+// via -qat-gen and excluded here.
+func DefaultKernelVfDrivers() string {
+	var names []string
+	for _, f := range qatFamilies {
+		if f.unified {
+			continue
+		}
+		names = append(names, f.vfDriver)
+	}
+	return strings.Join(names, ",")
+}
+
+// supportedDpdkDrivers lists the drivers -dpdk-driver may name: the
+// driver DPDK workloads expect their VFs bound to.
+var supportedDpdkDrivers = []string{"vfio-pci"}
+
+func familyForDriver(vfDriver string) (qatFamily, bool) {
+	for _, f := range qatFamilies {
+		if f.vfDriver == vfDriver {
+			return f, true
+		}
+	}
+	return qatFamily{}, false
+}
+
+type devicePlugin struct {
+	maxDevices       int
+	vfDrivers        []string
+	dpdkDriver       string
+	servicesOverride []string
+}
+
+// NewDevicePlugin returns a deviceplugin.Scanner that discovers QAT VFs
+// bound to any of the drivers in kernelVfDrivers (a comma separated
+// list) and advertises up to maxDevices of them for use with dpdkDriver.
+//
+// Normally the resource(s) a VF is advertised under are derived from the
+// ServicesEnabled setting in its PF's QAT config file. If services is
+// non-empty it overrides that discovery and every VF is advertised under
+// exactly the services listed there instead.
+//
+// qatGen selects the unified gen4 "qat" VF driver: "4" enables it
+// unconditionally, "" (the default) auto-enables it if gen4 hardware is
+// found by PCI ID, and "2"/"3" leave it disabled without probing for
+// gen4 hardware, since they're an explicit hint that the node isn't
+// gen4. Any other value is an error. qatGen need not be set at all if
+// "qat" is already listed in kernelVfDrivers.
+func NewDevicePlugin(maxDevices int, kernelVfDrivers string, dpdkDriver string, services string, qatGen string) (deviceplugin.Scanner, error) {
+	vfDrivers := strings.Split(kernelVfDrivers, ",")
+
+	switch qatGen {
+	case "4":
+		vfDrivers = appendUnique(vfDrivers, "qat")
+	case "":
+		vfDrivers = appendUnique(vfDrivers, detectUnifiedDrivers()...)
+	case "2", "3":
+		// An explicit non-gen4 hint: don't auto-detect gen4 hardware,
+		// the opposite of what the caller asked for.
+	default:
+		return nil, errors.Errorf("unknown QAT generation: %s", qatGen)
+	}
+
+	for _, vfDriver := range vfDrivers {
+		if _, ok := familyForDriver(vfDriver); !ok {
+			return nil, errors.Errorf("unknown QAT VF driver: %s", vfDriver)
+		}
+	}
+
+	supportedDpdkDriver := false
+	for _, d := range supportedDpdkDrivers {
+		if d == dpdkDriver {
+			supportedDpdkDriver = true
+			break
+		}
+	}
+	if !supportedDpdkDriver {
+		return nil, errors.Errorf("unsupported dpdk driver: %s", dpdkDriver)
+	}
+
+	servicesOverride, err := qatservices.ResolveList(services)
+	if err != nil {
+		return nil, err
+	}
+
+	if servicesOverride != nil {
+		supportedServices := make(map[string]bool)
+		for _, vfDriver := range vfDrivers {
+			family, _ := familyForDriver(vfDriver)
+			for _, s := range family.services {
+				supportedServices[s] = true
+			}
+		}
+		for _, s := range servicesOverride {
+			if !supportedServices[s] {
+				return nil, errors.Errorf("resolved service %q is not supported by any driver in %s", s, kernelVfDrivers)
+			}
+		}
+	}
+
+	return &devicePlugin{
+		maxDevices:       maxDevices,
+		vfDrivers:        vfDrivers,
+		dpdkDriver:       dpdkDriver,
+		servicesOverride: servicesOverride,
+	}, nil
+}
+
+// appendUnique appends the items in extra to list, skipping any that
+// list already contains.
+func appendUnique(list []string, extra ...string) []string {
+	for _, item := range extra {
+		found := false
+		for _, v := range list {
+			if v == item {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// detectUnifiedDrivers returns the vfDriver name of every unified QAT
+// family (see qatFamily.unified) whose VFs are present on this node,
+// identified by PCI device ID. It backs -qat-gen's auto mode.
+func detectUnifiedDrivers() []string {
+	matches, err := filepath.Glob(path.Join(pciBusPath, "*", "device"))
+	if err != nil {
+		return nil
+	}
+
+	var found []string
+	for _, m := range matches {
+		data, err := ioutil.ReadFile(m)
+		if err != nil {
+			continue
+		}
+		id := strings.TrimPrefix(strings.TrimSpace(string(data)), "0x")
+
+		for _, family := range qatFamilies {
+			if !family.unified {
+				continue
+			}
+			for _, vfID := range family.vfPCIIDs {
+				if id == vfID {
+					found = appendUnique(found, family.vfDriver)
+				}
+			}
+		}
+	}
+
+	return found
+}
+
+func (dp *devicePlugin) Scan(notifier deviceplugin.Notifier) error {
+	for {
+		tree, err := dp.scan()
+		if err != nil {
+			return err
+		}
+		notifier.Notify(tree)
+		time.Sleep(scanPeriod)
+	}
+}
+
+func (dp *devicePlugin) scan() (deviceplugin.DeviceTree, error) {
+	tree := deviceplugin.NewDeviceTree()
+	numDevices := 0
+
+	for _, vfDriver := range dp.vfDrivers {
+		if numDevices >= dp.maxDevices {
+			break
+		}
+
+		driverPath := path.Join(pciDriversPath, vfDriver)
+		entries, err := ioutil.ReadDir(driverPath)
+		if err != nil {
+			// The driver may simply not be loaded on this node: that's
+			// not fatal, just means this family has no VFs here.
+			continue
+		}
+
+		family, _ := familyForDriver(vfDriver)
+		vfsPerPF := make(map[string]int)
+
+		for _, entry := range entries {
+			if numDevices >= dp.maxDevices {
+				break
+			}
+
+			bdf := entry.Name()
+			if !isPCIAddress(bdf) {
+				continue
+			}
+
+			if pf, err := physfn(bdf); err == nil {
+				if vfsPerPF[pf] >= family.maxVFsPerPF {
+					// Guard against a PF reporting more VFs than this
+					// family can physically expose.
+					continue
+				}
+				vfsPerPF[pf]++
+			}
+
+			services, err := dp.servicesForVF(bdf, family)
+			if err != nil {
+				// Leave the VF unadvertised rather than failing the
+				// whole scan: a misconfigured or not-yet-written PF
+				// config file shouldn't take every other device down.
+				continue
+			}
+
+			nodes, err := nodesForVF(bdf)
+			if err != nil {
+				continue
+			}
+
+			for _, service := range services {
+				tree.AddDevice(service, bdf, deviceplugin.DeviceInfo{State: "Healthy", Nodes: nodes})
+			}
+			numDevices++
+		}
+	}
+
+	return tree, nil
+}
+
+// servicesForVF returns the resource names (e.g. "cy", "dc") that the VF
+// at bdf should be advertised under.
+func (dp *devicePlugin) servicesForVF(bdf string, family qatFamily) ([]string, error) {
+	if dp.servicesOverride != nil {
+		return dp.servicesOverride, nil
+	}
+
+	if family.unified {
+		return servicesFromCfgServices(bdf)
+	}
+
+	confPath, err := pfConfPath(bdf, family)
+	if err != nil {
+		return nil, err
+	}
+
+	return servicesFromConfig(confPath)
+}
+
+// isPCIAddress reports whether name looks like a PCI BDF address
+// (DDDD:BB:DD.F), which is how bound devices show up as symlinks under
+// /sys/bus/pci/drivers/<driver>/.
+func isPCIAddress(name string) bool {
+	return strings.Count(name, ":") == 2 && strings.Contains(name, ".")
+}
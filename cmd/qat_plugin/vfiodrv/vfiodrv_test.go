@@ -0,0 +1,316 @@
+// Copyright 2018 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfiodrv
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// vfPCIIDFixtures are the known PCI device IDs of each legacy family's
+// VFs (without the "0x" prefix), used to build synthetic sysfs trees
+// below.
+var vfPCIIDFixtures = map[string]string{
+	"dh895xccvf": "0443",
+	"c6xxvf":     "37c9",
+	"c3xxxvf":    "19e3",
+	"d15xxvf":    "6f55",
+	"c4xxxvf":    "18a1",
+	"200xxvf":    "18ef",
+}
+
+// withSyntheticSysfs points pciDriversPath, pciBusPath and qatConfDir at
+// fresh temp directories for the duration of the test.
+func withSyntheticSysfs(t *testing.T) (driversDir, devicesDir, confDir string) {
+	t.Helper()
+
+	root, err := ioutil.TempDir("", "vfiodrv-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(root) })
+
+	driversDir = filepath.Join(root, "drivers")
+	devicesDir = filepath.Join(root, "devices")
+	confDir = filepath.Join(root, "etc")
+	for _, d := range []string{driversDir, devicesDir, confDir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatalf("failed to create %s: %v", d, err)
+		}
+	}
+
+	origDrivers, origBus, origConf := pciDriversPath, pciBusPath, qatConfDir
+	pciDriversPath, pciBusPath, qatConfDir = driversDir, devicesDir, confDir
+	t.Cleanup(func() {
+		pciDriversPath, pciBusPath, qatConfDir = origDrivers, origBus, origConf
+	})
+
+	return driversDir, devicesDir, confDir
+}
+
+// addVF wires up a synthetic VF at bdf, bound to vfDriver and belonging
+// to the PF at pfBDF (whose driver directory is named pfDriver, e.g.
+// "c4xxx" for vfDriver "c4xxxvf").
+func addVF(t *testing.T, driversDir, devicesDir, vfDriver, pfDriver, pfBDF, bdf, deviceID string) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Join(driversDir, vfDriver, bdf), 0755); err != nil {
+		t.Fatalf("failed to bind VF %s to %s: %v", bdf, vfDriver, err)
+	}
+
+	vfDir := filepath.Join(devicesDir, bdf)
+	if err := os.MkdirAll(vfDir, 0755); err != nil {
+		t.Fatalf("failed to create device dir for %s: %v", bdf, err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(vfDir, "device"), []byte("0x"+deviceID+"\n"), 0644); err != nil {
+		t.Fatalf("failed to write device id for %s: %v", bdf, err)
+	}
+
+	pfDir := filepath.Join(devicesDir, pfBDF)
+	if err := os.MkdirAll(pfDir, 0755); err != nil {
+		t.Fatalf("failed to create PF dir for %s: %v", pfBDF, err)
+	}
+	if err := os.Symlink(pfDir, filepath.Join(vfDir, "physfn")); err != nil {
+		t.Fatalf("failed to symlink physfn for %s: %v", bdf, err)
+	}
+	if err := os.Symlink("/sys/kernel/iommu_groups/"+bdf, filepath.Join(vfDir, "iommu_group")); err != nil {
+		t.Fatalf("failed to symlink iommu_group for %s: %v", bdf, err)
+	}
+	if _, err := os.Lstat(filepath.Join(pfDir, "driver")); os.IsNotExist(err) {
+		if err := os.Symlink(filepath.Join(driversDir, pfDriver), filepath.Join(pfDir, "driver")); err != nil {
+			t.Fatalf("failed to symlink driver for %s: %v", pfBDF, err)
+		}
+	}
+}
+
+// writeConf writes a PF QAT config file with the given ServicesEnabled
+// value, e.g. writeConf(t, confDir, "c4xxx", 0, "asym").
+func writeConf(t *testing.T, confDir, confPrefix string, index int, servicesEnabled string) {
+	t.Helper()
+
+	name := confPrefix + "_dev" + strconv.Itoa(index) + ".conf"
+	content := "ServicesEnabled = " + servicesEnabled + "\n"
+	if err := ioutil.WriteFile(filepath.Join(confDir, name), []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write %s: %v", name, err)
+	}
+}
+
+// writeCfgServices writes the sysfs cfg_services attribute a gen4 VF
+// reports its configured service split through.
+func writeCfgServices(t *testing.T, devicesDir, bdf, value string) {
+	t.Helper()
+
+	dir := filepath.Join(devicesDir, bdf, "qat")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("failed to create qat dir for %s: %v", bdf, err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "cfg_services"), []byte(value+"\n"), 0644); err != nil {
+		t.Fatalf("failed to write cfg_services for %s: %v", bdf, err)
+	}
+}
+
+func contains(list []string, item string) bool {
+	for _, v := range list {
+		if v == item {
+			return true
+		}
+	}
+	return false
+}
+
+// TestCompatibilityMatrix exercises discovery against synthetic sysfs
+// trees shaped like gen2 (PF-config-driven, cy/dc), gen3
+// (PF-config-driven, including asym) and gen4 (unified driver,
+// cfg_services-driven) hardware, and checks that every advertised VF
+// gets its vfio device nodes.
+func TestCompatibilityMatrix(t *testing.T) {
+	tests := []struct {
+		name            string
+		vfDriver        string
+		confPrefix      string // empty selects the gen4 cfg_services path
+		deviceID        string
+		servicesEnabled string
+		cfgServices     string
+		wantResources   []string
+	}{
+		{
+			name: "gen2 c6xx", vfDriver: "c6xxvf", confPrefix: "c6xx",
+			deviceID: vfPCIIDFixtures["c6xxvf"], servicesEnabled: "cy;dc",
+			wantResources: []string{"cy", "dc"},
+		},
+		{
+			name: "gen3 c4xxx", vfDriver: "c4xxxvf", confPrefix: "c4xxx",
+			deviceID: vfPCIIDFixtures["c4xxxvf"], servicesEnabled: "asym",
+			wantResources: []string{"asym"},
+		},
+		{
+			name: "gen3 c4xxx three-service combination", vfDriver: "c4xxxvf", confPrefix: "c4xxx",
+			deviceID: vfPCIIDFixtures["c4xxxvf"], servicesEnabled: "sym;asym;dc",
+			wantResources: []string{"cy", "asym", "dc"},
+		},
+		{
+			name: "gen4 qat", vfDriver: "qat",
+			deviceID: "4941", cfgServices: "sym;asym",
+			wantResources: []string{"cy", "asym"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			driversDir, devicesDir, confDir := withSyntheticSysfs(t)
+
+			pfDriver := tt.confPrefix
+			if pfDriver == "" {
+				pfDriver = tt.vfDriver
+			}
+
+			const pfBDF, bdf = "0000:3d:00.0", "0000:3d:00.1"
+			addVF(t, driversDir, devicesDir, tt.vfDriver, pfDriver, pfBDF, bdf, tt.deviceID)
+			if tt.confPrefix != "" {
+				writeConf(t, confDir, tt.confPrefix, 0, tt.servicesEnabled)
+			} else {
+				writeCfgServices(t, devicesDir, bdf, tt.cfgServices)
+			}
+
+			dp, err := NewDevicePlugin(32, tt.vfDriver, "vfio-pci", "", "")
+			if err != nil {
+				t.Fatalf("NewDevicePlugin failed: %v", err)
+			}
+
+			tree, err := dp.(*devicePlugin).scan()
+			if err != nil {
+				t.Fatalf("scan failed: %v", err)
+			}
+
+			for _, resource := range tt.wantResources {
+				info, ok := tree[resource][bdf]
+				if !ok {
+					t.Fatalf("expected VF %s advertised under %q, tree: %+v", bdf, resource, tree)
+				}
+				if len(info.Nodes) != 2 {
+					t.Errorf("expected 2 device nodes (iommu group + vfio control) for %s, got %d", bdf, len(info.Nodes))
+				}
+			}
+		})
+	}
+}
+
+func TestQatGenEnablesUnifiedDriver(t *testing.T) {
+	dp, err := NewDevicePlugin(32, DefaultKernelVfDrivers(), "vfio-pci", "", "4")
+	if err != nil {
+		t.Fatalf("-qat-gen=4 should enable the qat driver, got error: %v", err)
+	}
+	if !contains(dp.(*devicePlugin).vfDrivers, "qat") {
+		t.Error("expected -qat-gen=4 to add the qat driver")
+	}
+}
+
+func TestQatGenExplicitNonGen4DoesNotAutoDetect(t *testing.T) {
+	driversDir, devicesDir, _ := withSyntheticSysfs(t)
+	addVF(t, driversDir, devicesDir, "qat", "qat", "0000:6a:00.0", "0000:6a:00.1", "4941")
+
+	for _, qatGen := range []string{"2", "3"} {
+		dp, err := NewDevicePlugin(32, DefaultKernelVfDrivers(), "vfio-pci", "", qatGen)
+		if err != nil {
+			t.Fatalf("NewDevicePlugin failed for -qat-gen=%s: %v", qatGen, err)
+		}
+		if contains(dp.(*devicePlugin).vfDrivers, "qat") {
+			t.Errorf("-qat-gen=%s should not auto-enable the gen4 qat driver even with gen4 hardware present", qatGen)
+		}
+	}
+}
+
+func TestQatGenAutoDetectsGen4ByPCIID(t *testing.T) {
+	driversDir, devicesDir, _ := withSyntheticSysfs(t)
+	addVF(t, driversDir, devicesDir, "qat", "qat", "0000:6a:00.0", "0000:6a:00.1", "4941")
+
+	dp, err := NewDevicePlugin(32, DefaultKernelVfDrivers(), "vfio-pci", "", "")
+	if err != nil {
+		t.Fatalf("NewDevicePlugin failed: %v", err)
+	}
+	if !contains(dp.(*devicePlugin).vfDrivers, "qat") {
+		t.Error("expected gen4 hardware to auto-enable the qat driver")
+	}
+}
+
+func TestDiscoverC4xxxAndFamily200xx(t *testing.T) {
+	driversDir, devicesDir, confDir := withSyntheticSysfs(t)
+
+	addVF(t, driversDir, devicesDir, "c4xxxvf", "c4xxx", "0000:3d:00.0", "0000:3d:00.1", vfPCIIDFixtures["c4xxxvf"])
+	writeConf(t, confDir, "c4xxx", 0, "asym")
+
+	addVF(t, driversDir, devicesDir, "200xxvf", "200xx", "0000:5e:00.0", "0000:5e:00.1", vfPCIIDFixtures["200xxvf"])
+	writeConf(t, confDir, "200xx", 0, "sym;asym")
+
+	dp, err := NewDevicePlugin(32, "c4xxxvf,200xxvf", "vfio-pci", "", "")
+	if err != nil {
+		t.Fatalf("NewDevicePlugin failed: %v", err)
+	}
+
+	tree, err := dp.(*devicePlugin).scan()
+	if err != nil {
+		t.Fatalf("scan failed: %v", err)
+	}
+
+	if _, ok := tree["asym"]["0000:3d:00.1"]; !ok {
+		t.Errorf("expected c4xxx VF 0000:3d:00.1 under resource %q, tree: %+v", "asym", tree)
+	}
+	if _, ok := tree["cy"]["0000:5e:00.1"]; !ok {
+		t.Errorf("expected 200xx VF 0000:5e:00.1 under resource %q, tree: %+v", "cy", tree)
+	}
+	if _, ok := tree["asym"]["0000:5e:00.1"]; !ok {
+		t.Errorf("expected 200xx VF 0000:5e:00.1 under resource %q, tree: %+v", "asym", tree)
+	}
+}
+
+func TestScanBoundsVFsPerPF(t *testing.T) {
+	driversDir, devicesDir, confDir := withSyntheticSysfs(t)
+
+	const maxVFs = 16 // matches qatFamilies' c4xxxvf entry
+	for i := 0; i < maxVFs+1; i++ {
+		bdf := "0000:3d:00." + strconv.Itoa(i+1)
+		addVF(t, driversDir, devicesDir, "c4xxxvf", "c4xxx", "0000:3d:00.0", bdf, vfPCIIDFixtures["c4xxxvf"])
+	}
+	writeConf(t, confDir, "c4xxx", 0, "asym")
+
+	dp, err := NewDevicePlugin(32, "c4xxxvf", "vfio-pci", "", "")
+	if err != nil {
+		t.Fatalf("NewDevicePlugin failed: %v", err)
+	}
+
+	tree, err := dp.(*devicePlugin).scan()
+	if err != nil {
+		t.Fatalf("scan failed: %v", err)
+	}
+
+	if got := len(tree["asym"]); got != maxVFs {
+		t.Errorf("got %d VFs advertised for a single PF, want %d (qatFamily.maxVFsPerPF bound)", got, maxVFs)
+	}
+}
+
+func TestNewDevicePluginRejectsUnsupportedDpdkDriver(t *testing.T) {
+	if _, err := NewDevicePlugin(32, DefaultKernelVfDrivers(), "igb_uio", "", ""); err == nil {
+		t.Error("expected an error for an unsupported -dpdk-driver, got nil")
+	}
+}
+
+func TestNewDevicePluginRejectsUnsupportedService(t *testing.T) {
+	if _, err := NewDevicePlugin(32, "dh895xccvf", "vfio-pci", "asym", ""); err == nil {
+		t.Error("expected an error overriding services with one dh895xcc doesn't support, got nil")
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright 2017 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package debug implements a very simple on/off logger that plugins can
+// use to print diagnostic information without pulling in a full logging
+// framework.
+package debug
+
+import (
+	"log"
+	"os"
+)
+
+var (
+	enabled = false
+	logger  = log.New(os.Stderr, "", log.LstdFlags)
+)
+
+// Activate turns on debug output.
+func Activate() {
+	enabled = true
+}
+
+// Enabled reports whether debug output is currently turned on.
+func Enabled() bool {
+	return enabled
+}
+
+// Print logs the given arguments when debug output is enabled.
+func Print(v ...interface{}) {
+	if enabled {
+		logger.Println(v...)
+	}
+}
+
+// Printf logs the given format string when debug output is enabled.
+func Printf(format string, v ...interface{}) {
+	if enabled {
+		logger.Printf(format, v...)
+	}
+}
@@ -0,0 +1,319 @@
+// Copyright 2017 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package deviceplugin provides the common scaffolding (kubelet
+// registration, gRPC server, rescan loop) shared by all the
+// Intel device plugins. Individual plugins only need to implement the
+// Scanner interface and hand a Manager their discovered devices.
+package deviceplugin
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	"github.com/intel/intel-device-plugins-for-kubernetes/pkg/debug"
+)
+
+// kubeletRegisterTimeout bounds how long connecting to kubelet's
+// registration socket may take before register gives up.
+const kubeletRegisterTimeout = 5 * time.Second
+
+// DeviceInfo contains the data needed to advertise a device to kubelet:
+// its health state plus the mounts, device nodes and environment
+// variables that must be added to a container that's allocated it.
+type DeviceInfo struct {
+	State  string
+	Nodes  []pluginapi.DeviceSpec
+	Mounts []pluginapi.Mount
+	Envs   map[string]string
+}
+
+// DeviceTree maps a resource name (e.g. "cy" or "dc") to the set of
+// devices that should be advertised under that resource.
+type DeviceTree map[string]map[string]DeviceInfo
+
+// NewDeviceTree creates an empty DeviceTree.
+func NewDeviceTree() DeviceTree {
+	return make(DeviceTree)
+}
+
+// AddDevice adds a device with the given ID to the named resource group.
+func (t DeviceTree) AddDevice(resourceName, deviceID string, info DeviceInfo) {
+	if _, ok := t[resourceName]; !ok {
+		t[resourceName] = make(map[string]DeviceInfo)
+	}
+	t[resourceName][deviceID] = info
+}
+
+// Notifier receives updated DeviceTrees from a Scanner every time it
+// completes a scan.
+type Notifier interface {
+	Notify(DeviceTree)
+}
+
+// Scanner is implemented by every plugin. Scan runs until it fails,
+// pushing an updated DeviceTree to notifier after every scan.
+type Scanner interface {
+	Scan(Notifier) error
+}
+
+// Manager owns the lifetime of the plugins derived from a single
+// Scanner: it runs the scan loop and, for every resource name the
+// Scanner reports, registers and serves a kubelet device plugin gRPC
+// endpoint.
+type Manager struct {
+	namespace string
+	scanner   Scanner
+	plugins   map[string]*devicePluginServer
+	rescan    chan DeviceTree
+}
+
+// NewManager creates a Manager that will advertise resources under
+// "<namespace>/<resourceName>".
+func NewManager(namespace string, scanner Scanner) *Manager {
+	return &Manager{
+		namespace: namespace,
+		scanner:   scanner,
+		plugins:   make(map[string]*devicePluginServer),
+		rescan:    make(chan DeviceTree),
+	}
+}
+
+// Notify implements Notifier. It is called by the Scanner.
+func (m *Manager) Notify(tree DeviceTree) {
+	m.rescan <- tree
+}
+
+// Run starts the scan loop and blocks forever, (re)registering plugins
+// with kubelet as the set of advertised resources changes.
+func (m *Manager) Run() {
+	go func() {
+		if err := m.scanner.Scan(m); err != nil {
+			debug.Printf("scan failed: %+v", err)
+		}
+	}()
+
+	for tree := range m.rescan {
+		for resourceName, devices := range tree {
+			plugin, ok := m.plugins[resourceName]
+			if !ok {
+				plugin = newDevicePluginServer(m.namespace, resourceName)
+				m.plugins[resourceName] = plugin
+				go plugin.Serve()
+			}
+			plugin.update(devices)
+		}
+
+		for resourceName, plugin := range m.plugins {
+			if _, ok := tree[resourceName]; ok {
+				continue
+			}
+			// The resource's last device disappeared from this scan:
+			// stop advertising it to kubelet instead of leaving a
+			// stale server (and a stale socket) behind.
+			plugin.Stop()
+			delete(m.plugins, resourceName)
+		}
+	}
+}
+
+// devicePluginServer is the kubelet-facing gRPC endpoint for a single
+// resource name. It implements pluginapi.DevicePluginServer.
+type devicePluginServer struct {
+	resourceName string
+	socketPath   string
+
+	mu      sync.Mutex
+	devices map[string]DeviceInfo
+	notify  chan struct{}
+
+	server *grpc.Server
+}
+
+func newDevicePluginServer(namespace, resourceName string) *devicePluginServer {
+	fullName := namespace + "/" + resourceName
+	socketName := strings.ReplaceAll(fullName, "/", "-") + ".sock"
+
+	return &devicePluginServer{
+		resourceName: fullName,
+		socketPath:   filepath.Join(pluginapi.DevicePluginPath, socketName),
+		notify:       make(chan struct{}),
+	}
+}
+
+// update replaces the advertised device set and wakes any ListAndWatch
+// calls blocked waiting for a change.
+func (s *devicePluginServer) update(devices map[string]DeviceInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.devices = devices
+	close(s.notify)
+	s.notify = make(chan struct{})
+}
+
+// snapshot returns the current device set and the channel that will be
+// closed the next time it changes.
+func (s *devicePluginServer) snapshot() (map[string]DeviceInfo, chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.devices, s.notify
+}
+
+// Serve starts the gRPC endpoint and registers it with kubelet. It
+// returns once registration has been attempted; the server itself keeps
+// running in the background until Stop is called.
+func (s *devicePluginServer) Serve() {
+	if err := os.Remove(s.socketPath); err != nil && !os.IsNotExist(err) {
+		debug.Printf("failed to remove stale socket %s: %+v", s.socketPath, err)
+		return
+	}
+
+	lis, err := net.Listen("unix", s.socketPath)
+	if err != nil {
+		debug.Printf("failed to listen on %s: %+v", s.socketPath, err)
+		return
+	}
+
+	s.server = grpc.NewServer()
+	pluginapi.RegisterDevicePluginServer(s.server, s)
+
+	go func() {
+		if err := s.server.Serve(lis); err != nil {
+			debug.Printf("%s plugin server stopped: %+v", s.resourceName, err)
+		}
+	}()
+
+	if err := s.register(); err != nil {
+		debug.Printf("failed to register %s with kubelet: %+v", s.resourceName, err)
+	}
+}
+
+// Stop tears down the gRPC server and removes its socket.
+func (s *devicePluginServer) Stop() {
+	if s.server != nil {
+		s.server.Stop()
+	}
+	if err := os.Remove(s.socketPath); err != nil && !os.IsNotExist(err) {
+		debug.Printf("failed to remove socket %s: %+v", s.socketPath, err)
+	}
+}
+
+// register dials kubelet's well-known socket and advertises this
+// server's endpoint and resource name to it.
+func (s *devicePluginServer) register() error {
+	conn, err := grpc.DialContext(
+		context.Background(),
+		pluginapi.KubeletSocket,
+		grpc.WithInsecure(),
+		grpc.WithBlock(),
+		grpc.WithTimeout(kubeletRegisterTimeout),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", addr)
+		}),
+	)
+	if err != nil {
+		return errors.Wrap(err, "failed to connect to kubelet")
+	}
+	defer conn.Close()
+
+	_, err = pluginapi.NewRegistrationClient(conn).Register(context.Background(), &pluginapi.RegisterRequest{
+		Version:      pluginapi.Version,
+		Endpoint:     filepath.Base(s.socketPath),
+		ResourceName: s.resourceName,
+	})
+	if err != nil {
+		return errors.Wrap(err, "Register call to kubelet failed")
+	}
+
+	return nil
+}
+
+func (s *devicePluginServer) GetDevicePluginOptions(context.Context, *pluginapi.Empty) (*pluginapi.DevicePluginOptions, error) {
+	return &pluginapi.DevicePluginOptions{}, nil
+}
+
+func (s *devicePluginServer) ListAndWatch(e *pluginapi.Empty, stream pluginapi.DevicePlugin_ListAndWatchServer) error {
+	for {
+		devices, notify := s.snapshot()
+
+		if err := stream.Send(&pluginapi.ListAndWatchResponse{Devices: toPluginDevices(devices)}); err != nil {
+			return errors.Wrap(err, "failed to send device list to kubelet")
+		}
+
+		select {
+		case <-notify:
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+func (s *devicePluginServer) GetPreferredAllocation(context.Context, *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
+	return &pluginapi.PreferredAllocationResponse{}, nil
+}
+
+func (s *devicePluginServer) Allocate(ctx context.Context, req *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
+	devices, _ := s.snapshot()
+
+	resp := &pluginapi.AllocateResponse{}
+	for _, car := range req.ContainerRequests {
+		containerResp := &pluginapi.ContainerAllocateResponse{Envs: make(map[string]string)}
+
+		for _, id := range car.DevicesIDs {
+			info, ok := devices[id]
+			if !ok {
+				return nil, errors.Errorf("unknown device %q requested for %s", id, s.resourceName)
+			}
+
+			for i := range info.Nodes {
+				containerResp.Devices = append(containerResp.Devices, &info.Nodes[i])
+			}
+			for i := range info.Mounts {
+				containerResp.Mounts = append(containerResp.Mounts, &info.Mounts[i])
+			}
+			for k, v := range info.Envs {
+				containerResp.Envs[k] = v
+			}
+		}
+
+		resp.ContainerResponses = append(resp.ContainerResponses, containerResp)
+	}
+
+	return resp, nil
+}
+
+func (s *devicePluginServer) PreStartContainer(context.Context, *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
+	return &pluginapi.PreStartContainerResponse{}, nil
+}
+
+// toPluginDevices converts a plugin's internal device map to the slice
+// format ListAndWatch reports to kubelet.
+func toPluginDevices(devices map[string]DeviceInfo) []*pluginapi.Device {
+	list := make([]*pluginapi.Device, 0, len(devices))
+	for id, info := range devices {
+		list = append(list, &pluginapi.Device{ID: id, Health: info.State})
+	}
+	return list
+}